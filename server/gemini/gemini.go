@@ -4,6 +4,7 @@
 package gemini
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,21 +13,66 @@ import (
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	"github.com/mattermost/mattermost-plugin-ai/server/llm"
 	"github.com/mattermost/mattermost-plugin-ai/server/metrics"
 )
 
+// defaultFileUploadThresholdBytes is the attachment size above which we
+// upload to Gemini's File API instead of inlining the bytes in the request.
+const defaultFileUploadThresholdBytes = 20 * 1024 * 1024
+
+// SafetySetting maps a Gemini harm category to the blocking threshold an
+// admin wants enforced for it, e.g. {"HARM_CATEGORY_HARASSMENT", "BLOCK_NONE"}
+// to loosen the default for an internal use case.
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+// ModelRouting configures how the provider picks between multiple Gemini
+// models depending on the size of a request's conversation.
+type ModelRouting struct {
+	// DefaultModel is used for requests that need neither the large-context
+	// nor the Flash model.
+	DefaultModel string `json:"defaultModel"`
+	// LargeContextModel is used once a request's estimated token count
+	// exceeds LargeContextThreshold.
+	LargeContextModel string `json:"largeContextModel"`
+	// FlashModel is preferred for latency-sensitive requests that fit
+	// comfortably within its context window.
+	FlashModel string `json:"flashModel"`
+	// LargeContextThreshold is the token count above which requests are
+	// routed to LargeContextModel instead of DefaultModel.
+	LargeContextThreshold int32 `json:"largeContextThreshold"`
+}
+
+// modelContextWindows records the token context window of each Gemini model
+// this provider knows about, used to pick a sensible default
+// LargeContextThreshold.
+var modelContextWindows = map[string]int32{
+	"gemini-pro":        30720,
+	"gemini-pro-vision": 12288,
+	"gemini-1.5-pro":    2097152,
+	"gemini-1.5-flash":  1048576,
+	"gemini-2.0-flash":  1048576,
+}
+
 // Config holds the configuration for the Gemini provider
 type Config struct {
-	APIKey        string   `json:"apiKey"`
-	ModelName     string   `json:"modelName"`
-	MaxTokens     int      `json:"maxTokens"`
-	Temperature   float32  `json:"temperature"`
-	TopP          float32  `json:"topP"`
-	TopK          int32    `json:"topK"`
-	StopSequences []string `json:"stopSequences"`
+	APIKey                   string          `json:"apiKey"`
+	ModelName                string          `json:"modelName"`
+	EmbeddingModelName       string          `json:"embeddingModelName"`
+	MaxTokens                int             `json:"maxTokens"`
+	Temperature              float32         `json:"temperature"`
+	TopP                     float32         `json:"topP"`
+	TopK                     int32           `json:"topK"`
+	StopSequences            []string        `json:"stopSequences"`
+	FileUploadThresholdBytes int             `json:"fileUploadThresholdBytes"`
+	SafetySettings           []SafetySetting `json:"safetySettings"`
+	ModelRouting             ModelRouting    `json:"modelRouting"`
 }
 
 // Gemini implements the llm.LanguageModel interface for Google's Gemini API
@@ -43,7 +89,7 @@ func New(serviceConfig llm.ServiceConfig, httpClient *http.Client, metrics *metr
 	if err := json.Unmarshal(serviceConfig.Parameters, &config); err != nil {
 		// Just use default config if unmarshal fails
 	}
-	
+
 	return &Gemini{
 		config:     config,
 		httpClient: httpClient,
@@ -60,6 +106,31 @@ func (g *Gemini) Initialize() error {
 		g.config.ModelName = "gemini-pro"
 	}
 
+	if g.config.EmbeddingModelName == "" {
+		g.config.EmbeddingModelName = "text-embedding-004"
+	}
+
+	if g.config.FileUploadThresholdBytes == 0 {
+		g.config.FileUploadThresholdBytes = defaultFileUploadThresholdBytes
+	}
+
+	if g.config.ModelRouting.DefaultModel == "" {
+		g.config.ModelRouting.DefaultModel = g.config.ModelName
+	}
+	if g.config.ModelRouting.FlashModel == "" {
+		g.config.ModelRouting.FlashModel = "gemini-1.5-flash"
+	}
+	if g.config.ModelRouting.LargeContextModel == "" {
+		g.config.ModelRouting.LargeContextModel = "gemini-1.5-pro"
+	}
+	if g.config.ModelRouting.LargeContextThreshold == 0 {
+		if window, ok := modelContextWindows[g.config.ModelRouting.DefaultModel]; ok {
+			g.config.ModelRouting.LargeContextThreshold = window / 4
+		} else {
+			g.config.ModelRouting.LargeContextThreshold = 30000
+		}
+	}
+
 	client, err := genai.NewClient(context.Background(), option.WithAPIKey(g.config.APIKey), option.WithHTTPClient(g.httpClient))
 	if err != nil {
 		return fmt.Errorf("failed to create Gemini client: %w", err)
@@ -95,10 +166,193 @@ func (g *Gemini) GetChatCompletion(ctx context.Context, messages []llm.Message,
 	}
 
 	opts := llm.NewOptions(options...)
-	
-	model := g.client.GenerativeModel(g.config.ModelName)
-	
-	// Configure the model based on our config and options
+
+	systemInstruction, chatMessages := splitSystemInstruction(messages)
+
+	if len(chatMessages) == 0 {
+		return nil, errors.New("no messages to send")
+	}
+
+	lastMessage := chatMessages[len(chatMessages)-1]
+
+	var uploaded []string
+	defer func() { g.cleanupUploadedFiles(uploaded) }()
+
+	history, historyUploaded, err := g.toGeminiContents(ctx, chatMessages[:len(chatMessages)-1])
+	uploaded = append(uploaded, historyUploaded...)
+	if err != nil {
+		return nil, err
+	}
+
+	lastParts, lastUploaded, err := g.toGeminiParts(ctx, lastMessage)
+	uploaded = append(uploaded, lastUploaded...)
+	if err != nil {
+		return nil, err
+	}
+
+	model := g.client.GenerativeModel(g.selectModel(ctx, history, lastParts))
+	g.configureModel(model)
+	g.configureTools(model, opts)
+	model.SystemInstruction = systemInstruction
+
+	cs := model.StartChat()
+	cs.History = history
+
+	// Generate content for the current turn, with the rest of the
+	// conversation passed as history rather than flattened into the prompt.
+	resp, err := cs.SendMessage(ctx, lastParts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate content: %w", err)
+	}
+
+	if err := g.checkBlocked(resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Candidates) == 0 {
+		return nil, errors.New("no response generated")
+	}
+
+	// Extract the response text and any tool calls the model wants to make
+	candidate := resp.Candidates[0]
+	parts := candidateParts(candidate)
+	if len(parts) == 0 {
+		return nil, errors.New("no response generated")
+	}
+
+	responseText := ""
+	for _, part := range parts {
+		if textPart, ok := part.(genai.Text); ok {
+			responseText += string(textPart)
+		}
+	}
+
+	return &llm.Response{
+		Content:   responseText,
+		ToolCalls: extractToolCalls(parts),
+		Warning:   maxTokensWarning(candidate),
+	}, nil
+}
+
+// GetChatCompletionStream implements the llm.LanguageModel interface, streaming
+// response chunks to the caller as they are produced by Gemini's
+// GenerateContentStream endpoint instead of waiting for the full response.
+func (g *Gemini) GetChatCompletionStream(ctx context.Context, messages []llm.Message, options ...llm.Option) (*llm.TextStreamResult, error) {
+	if g.client == nil {
+		if err := g.Initialize(); err != nil {
+			return nil, err
+		}
+	}
+
+	if g.metrics != nil {
+		g.metrics.ObserveRequest()
+	}
+
+	opts := llm.NewOptions(options...)
+
+	systemInstruction, chatMessages := splitSystemInstruction(messages)
+
+	if len(chatMessages) == 0 {
+		return nil, errors.New("no messages to send")
+	}
+
+	lastMessage := chatMessages[len(chatMessages)-1]
+
+	history, uploaded, err := g.toGeminiContents(ctx, chatMessages[:len(chatMessages)-1])
+	if err != nil {
+		g.cleanupUploadedFiles(uploaded)
+		return nil, err
+	}
+
+	lastParts, lastUploaded, err := g.toGeminiParts(ctx, lastMessage)
+	uploaded = append(uploaded, lastUploaded...)
+	if err != nil {
+		g.cleanupUploadedFiles(uploaded)
+		return nil, err
+	}
+
+	model := g.client.GenerativeModel(g.selectModel(ctx, history, lastParts))
+	g.configureModel(model)
+	g.configureTools(model, opts)
+	model.SystemInstruction = systemInstruction
+
+	cs := model.StartChat()
+	cs.History = history
+
+	iter := cs.SendMessageStream(ctx, lastParts...)
+
+	stream := make(chan string)
+	toolCalls := make(chan []llm.ToolCall, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(stream)
+		defer close(toolCalls)
+		defer close(errChan)
+		defer g.cleanupUploadedFiles(uploaded)
+		if g.metrics != nil {
+			defer g.metrics.ObserveResponse()
+		}
+
+		for {
+			resp, err := iter.Next()
+			if err == iterator.Done {
+				return
+			}
+			if err != nil {
+				errChan <- fmt.Errorf("failed to stream content: %w", err)
+				return
+			}
+
+			if err := g.checkBlocked(resp); err != nil {
+				errChan <- err
+				return
+			}
+
+			if len(resp.Candidates) == 0 {
+				continue
+			}
+
+			parts := candidateParts(resp.Candidates[0])
+			if len(parts) == 0 {
+				continue
+			}
+
+			// A function call part ends this turn of the conversation -
+			// forward it the same way GetChatCompletion does instead of
+			// silently dropping it once only text parts are streamed.
+			if calls := extractToolCalls(parts); len(calls) > 0 {
+				select {
+				case toolCalls <- calls:
+				case <-ctx.Done():
+					errChan <- ctx.Err()
+				}
+				return
+			}
+
+			for _, part := range parts {
+				textPart, ok := part.(genai.Text)
+				if !ok {
+					continue
+				}
+
+				select {
+				case stream <- string(textPart):
+				case <-ctx.Done():
+					errChan <- ctx.Err()
+					return
+				}
+			}
+		}
+	}()
+
+	return &llm.TextStreamResult{Stream: stream, ToolCalls: toolCalls, Err: errChan}, nil
+}
+
+// configureModel applies the provider's configuration to a GenerativeModel
+// instance so that GetChatCompletion, GetChatCompletionStream and GetVision
+// all generate content under the same sampling parameters.
+func (g *Gemini) configureModel(model *genai.GenerativeModel) {
 	model.SetTemperature(float64(g.config.Temperature))
 	if g.config.MaxTokens > 0 {
 		model.SetMaxOutputTokens(int32(g.config.MaxTokens))
@@ -109,168 +363,694 @@ func (g *Gemini) GetChatCompletion(ctx context.Context, messages []llm.Message,
 	if g.config.TopK > 0 {
 		model.SetTopK(g.config.TopK)
 	}
-	
 	// Note: Gemini Go SDK doesn't have SetStopSequences method
 	// We'll skip this functionality for now
-	
-	// Convert Mattermost messages to Gemini chat messages
-	var geminiContents []*genai.Content
-	for _, msg := range messages {
-		content := &genai.Content{
-			Parts: []genai.Part{
-				genai.Text(msg.Content),
-			},
+
+	model.SafetySettings = toGeminiSafetySettings(g.config.SafetySettings)
+}
+
+var safetyCategories = map[string]genai.HarmCategory{
+	"HARM_CATEGORY_HARASSMENT":        genai.HarmCategoryHarassment,
+	"HARM_CATEGORY_HATE_SPEECH":       genai.HarmCategoryHateSpeech,
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT": genai.HarmCategorySexuallyExplicit,
+	"HARM_CATEGORY_DANGEROUS_CONTENT": genai.HarmCategoryDangerousContent,
+}
+
+var safetyThresholds = map[string]genai.HarmBlockThreshold{
+	"BLOCK_NONE":             genai.HarmBlockNone,
+	"BLOCK_ONLY_HIGH":        genai.HarmBlockOnlyHigh,
+	"BLOCK_MEDIUM_AND_ABOVE": genai.HarmBlockMediumAndAbove,
+	"BLOCK_LOW_AND_ABOVE":    genai.HarmBlockLowAndAbove,
+}
+
+// toGeminiSafetySettings converts the provider's configured safety
+// thresholds into genai.SafetySetting values. Entries with an unrecognized
+// category or threshold are skipped so a typo in one setting doesn't
+// prevent the rest of the configuration from taking effect.
+func toGeminiSafetySettings(settings []SafetySetting) []*genai.SafetySetting {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	geminiSettings := make([]*genai.SafetySetting, 0, len(settings))
+	for _, setting := range settings {
+		category, ok := safetyCategories[setting.Category]
+		if !ok {
+			continue
 		}
-		
-		switch msg.Role {
-		case llm.RoleUser:
-			content.Role = "user"
-		case llm.RoleAssistant:
-			content.Role = "model"
-		case llm.RoleSystem:
-			// Gemini doesn't have a system role, so we'll use user role with a prefix
-			content.Role = "user"
-			content.Parts = []genai.Part{
-				genai.Text("System instruction: " + msg.Content),
+
+		threshold, ok := safetyThresholds[setting.Threshold]
+		if !ok {
+			continue
+		}
+
+		geminiSettings = append(geminiSettings, &genai.SafetySetting{
+			Category:  category,
+			Threshold: threshold,
+		})
+	}
+
+	return geminiSettings
+}
+
+// configuredThreshold returns the admin-configured block threshold for the
+// given harm category, as set in g.config.SafetySettings, or "" if that
+// category wasn't explicitly configured.
+func (g *Gemini) configuredThreshold(category genai.HarmCategory) string {
+	for _, setting := range g.config.SafetySettings {
+		if safetyCategories[setting.Category] == category {
+			return setting.Threshold
+		}
+	}
+
+	return ""
+}
+
+// checkBlocked inspects a GenerateContentResponse for prompt- or
+// candidate-level safety blocks and, if found, returns a typed
+// llm.SafetyBlockedError describing why, so upstream code can show the user
+// something more useful than a generic "no response generated" error.
+func (g *Gemini) checkBlocked(resp *genai.GenerateContentResponse) error {
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+		return &llm.SafetyBlockedError{
+			Reason: resp.PromptFeedback.BlockReason.String(),
+		}
+	}
+
+	if len(resp.Candidates) == 0 {
+		return nil
+	}
+
+	candidate := resp.Candidates[0]
+	if candidate.FinishReason != genai.FinishReasonSafety && candidate.FinishReason != genai.FinishReasonRecitation {
+		return nil
+	}
+
+	for _, rating := range candidate.SafetyRatings {
+		if rating.Blocked {
+			return &llm.SafetyBlockedError{
+				Category:  rating.Category.String(),
+				Threshold: g.configuredThreshold(rating.Category),
+				Reason:    candidate.FinishReason.String(),
 			}
 		}
-		
-		geminiContents = append(geminiContents, content)
 	}
-	
-	// Generate content
-	resp, err := model.GenerateContent(ctx, geminiContents...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate content: %w", err)
+
+	return &llm.SafetyBlockedError{Reason: candidate.FinishReason.String()}
+}
+
+// candidateParts returns a candidate's content parts, or nil if the
+// candidate has no content at all. Content is nil for finish reasons other
+// than Safety/Recitation that checkBlocked doesn't special-case, e.g.
+// FinishReasonOther or a candidate that generated zero tokens, so callers
+// must go through this rather than indexing candidate.Content.Parts directly.
+func candidateParts(candidate *genai.Candidate) []genai.Part {
+	if candidate.Content == nil {
+		return nil
 	}
-	
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
-		return nil, errors.New("no response generated")
+	return candidate.Content.Parts
+}
+
+// maxTokensWarning returns a warning describing a truncated response when a
+// candidate was cut off by the model's output limit, and an empty string
+// otherwise.
+func maxTokensWarning(candidate *genai.Candidate) string {
+	if candidate.FinishReason != genai.FinishReasonMaxTokens {
+		return ""
 	}
-	
-	// Extract the response text
-	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
-		if textPart, ok := part.(genai.Text); ok {
-			responseText += string(textPart)
+	return "response truncated: MAX_TOKENS"
+}
+
+// splitSystemInstruction pulls any llm.RoleSystem messages out of the
+// conversation and merges them into a single Content suitable for
+// GenerativeModel.SystemInstruction, leaving the remaining user/assistant
+// turns untouched. It returns a nil Content when there are no system
+// messages, matching the zero value GenerativeModel.SystemInstruction
+// already has.
+func splitSystemInstruction(messages []llm.Message) (*genai.Content, []llm.Message) {
+	var systemInstructions []string
+	chatMessages := make([]llm.Message, 0, len(messages))
+
+	for _, msg := range messages {
+		if msg.Role == llm.RoleSystem {
+			systemInstructions = append(systemInstructions, msg.Content)
+			continue
 		}
+		chatMessages = append(chatMessages, msg)
 	}
-	
-	return &llm.Response{
-		Content: responseText,
-	}, nil
+
+	if len(systemInstructions) == 0 {
+		return nil, chatMessages
+	}
+
+	return &genai.Content{
+		Parts: []genai.Part{genai.Text(strings.Join(systemInstructions, "\n\n"))},
+	}, chatMessages
 }
 
-// GetEmbedding implements the llm.LanguageModel interface
-func (g *Gemini) GetEmbedding(ctx context.Context, input string) ([]float32, error) {
-	// Gemini currently doesn't support embeddings through the Go SDK
-	// This is a placeholder for when it becomes available
-	return nil, errors.New("embedding not supported by Gemini provider")
+// isInlineableImage reports whether an attachment is small enough, and a
+// plain enough type, to send as an inline Blob rather than uploading it to
+// Gemini's File API first.
+func (g *Gemini) isInlineableImage(attachment llm.Attachment) bool {
+	return strings.HasPrefix(attachment.MimeType, "image/") && len(attachment.Data) <= g.config.FileUploadThresholdBytes
 }
 
-// GetTranscription implements the llm.LanguageModel interface
-func (g *Gemini) GetTranscription(ctx context.Context, audioData []byte, prompt string) (string, error) {
-	// Gemini currently doesn't support audio transcription through the Go SDK
-	return "", errors.New("transcription not supported by Gemini provider")
+// isSupportedAttachment reports whether Gemini natively understands this
+// attachment's media type at all.
+func isSupportedAttachment(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/") ||
+		strings.HasPrefix(mimeType, "audio/") ||
+		strings.HasPrefix(mimeType, "video/") ||
+		mimeType == "application/pdf"
 }
 
-// GetVision implements the llm.LanguageModel interface
-func (g *Gemini) GetVision(ctx context.Context, messages []llm.Message, options ...llm.Option) (*llm.Response, error) {
-	// Check if we have a vision-capable model
-	if !strings.Contains(g.config.ModelName, "vision") {
-		// Switch to vision model if available
-		g.config.ModelName = "gemini-pro-vision"
+// toGeminiPart converts a single attachment into a genai.Part. Small images
+// are inlined as a Blob; everything else (audio, video, PDFs, and large
+// images) is uploaded via client.UploadFile and referenced by URI instead.
+// The returned file name is non-empty when the caller must later call
+// cleanupUploadedFiles to remove it.
+func (g *Gemini) toGeminiPart(ctx context.Context, attachment llm.Attachment) (genai.Part, string, error) {
+	if g.isInlineableImage(attachment) {
+		return genai.Blob{MIMEType: attachment.MimeType, Data: attachment.Data}, "", nil
 	}
-	
-	// Process the messages to include images
-	var geminiContents []*genai.Content
-	for _, msg := range messages {
-		content := &genai.Content{
-			Parts: []genai.Part{},
+
+	if !isSupportedAttachment(attachment.MimeType) {
+		return nil, "", fmt.Errorf("unsupported attachment mime type: %s", attachment.MimeType)
+	}
+
+	file, err := g.client.UploadFile(ctx, "", bytes.NewReader(attachment.Data), &genai.UploadFileOptions{MIMEType: attachment.MimeType})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to upload attachment: %w", err)
+	}
+
+	return genai.FileData{MIMEType: attachment.MimeType, URI: file.URI}, file.Name, nil
+}
+
+// toGeminiParts converts a single chat message's text, attachments, tool
+// calls and tool results into the genai.Part values for one turn of the
+// conversation. It returns the names of any files uploaded along the way so
+// the caller can clean them up once the request completes.
+func (g *Gemini) toGeminiParts(ctx context.Context, msg llm.Message) ([]genai.Part, []string, error) {
+	var parts []genai.Part
+	var uploaded []string
+
+	if msg.Content != "" {
+		parts = append(parts, genai.Text(msg.Content))
+	}
+
+	for _, attachment := range msg.Attachments {
+		part, fileName, err := g.toGeminiPart(ctx, attachment)
+		if err != nil {
+			return nil, uploaded, err
 		}
-		
-		// Add text content
-		if msg.Content != "" {
-			content.Parts = append(content.Parts, genai.Text(msg.Content))
+		parts = append(parts, part)
+		if fileName != "" {
+			uploaded = append(uploaded, fileName)
 		}
-		
-		// Add image attachments if any
-		for _, attachment := range msg.Attachments {
-			if strings.HasPrefix(attachment.MimeType, "image/") {
-				imgData := genai.ImageData{
-					MIMEType: attachment.MimeType,
-					Data:     attachment.Data,
-				}
-				content.Parts = append(content.Parts, genai.Blob{Data: imgData})
+	}
+
+	// An assistant turn that requested tools must carry its FunctionCall
+	// parts back into history, since Gemini requires a FunctionCall to
+	// precede the FunctionResponse that answers it.
+	for _, call := range msg.ToolCalls {
+		var args map[string]any
+		if len(call.Arguments) > 0 {
+			if err := json.Unmarshal(call.Arguments, &args); err != nil {
+				return nil, uploaded, fmt.Errorf("failed to unmarshal tool call arguments: %w", err)
 			}
 		}
-		
+		parts = append(parts, genai.FunctionCall{Name: call.Name, Args: args})
+	}
+
+	for _, result := range msg.ToolResults {
+		parts = append(parts, genai.FunctionResponse{
+			Name:     result.Name,
+			Response: map[string]any{"result": result.Content},
+		})
+	}
+
+	return parts, uploaded, nil
+}
+
+// toGeminiContents converts a sequence of Mattermost chat messages into the
+// Content slice the genai SDK uses for chat history, uploading any
+// attachments that don't fit inline. Callers are expected to have already
+// removed any llm.RoleSystem messages via splitSystemInstruction, and must
+// clean up the returned file names once the request completes.
+func (g *Gemini) toGeminiContents(ctx context.Context, messages []llm.Message) ([]*genai.Content, []string, error) {
+	var geminiContents []*genai.Content
+	var uploaded []string
+	for _, msg := range messages {
+		parts, fileNames, err := g.toGeminiParts(ctx, msg)
+		uploaded = append(uploaded, fileNames...)
+		if err != nil {
+			return nil, uploaded, err
+		}
+
+		content := &genai.Content{Parts: parts}
+
 		switch msg.Role {
-		case llm.RoleUser:
+		case llm.RoleUser, llm.RoleTool:
+			// genai.ChatSession.SendMessage has no way to send the current
+			// turn under any role but "user" (it always wraps the parts
+			// passed to it in NewUserContent), so a tool result that lands
+			// as the final message of a request goes out as role "user".
+			// Match that here for history entries too, rather than mixing
+			// a different role into history for the same kind of content.
 			content.Role = "user"
 		case llm.RoleAssistant:
 			content.Role = "model"
-		case llm.RoleSystem:
-			content.Role = "user"
-			// Prepend system instruction to first part if it's text
-			if len(content.Parts) > 0 {
-				if textPart, ok := content.Parts[0].(genai.Text); ok {
-					content.Parts[0] = genai.Text("System instruction: " + string(textPart))
-				} else {
-					// Insert system instruction at the beginning
-					newParts := make([]genai.Part, len(content.Parts)+1)
-					newParts[0] = genai.Text("System instruction: ")
-					copy(newParts[1:], content.Parts)
-					content.Parts = newParts
-				}
-			} else {
-				content.Parts = append(content.Parts, genai.Text("System instruction: "))
-			}
 		}
-		
+
 		geminiContents = append(geminiContents, content)
 	}
-	
-	// Use the same completion logic as GetChatCompletion
+	return geminiContents, uploaded, nil
+}
+
+// cleanupUploadedFiles deletes any files uploaded to Gemini's File API for a
+// request now that it has completed (or been abandoned), so they don't
+// linger in the account's storage quota. It always runs against a fresh
+// background context since the request's own context may already be
+// canceled by the time cleanup happens.
+func (g *Gemini) cleanupUploadedFiles(names []string) {
+	for _, name := range names {
+		_ = g.client.DeleteFile(context.Background(), name)
+	}
+}
+
+// smallRequestTokenThreshold is the local, estimated token count at or below
+// which a request is considered short and latency-sensitive enough to route
+// straight to FlashModel without paying for a remote CountTokens call.
+const smallRequestTokenThreshold = 2000
+
+// estimatedTokensPerNonTextPart is the flat per-part token estimate used for
+// attachments (images, audio, video, files) when locally estimating a
+// request's size, since their real token cost depends on server-side
+// processing we can't predict without calling CountTokens.
+const estimatedTokensPerNonTextPart = 258
+
+// estimateTokens returns a cheap, local estimate of the token count for a
+// set of parts, using ~4 characters per token for text as a rule of thumb.
+// It exists so selectModel can recognize an obviously short request without
+// a network round-trip.
+func estimateTokens(parts []genai.Part) int {
+	total := 0
+	for _, part := range parts {
+		if textPart, ok := part.(genai.Text); ok {
+			total += len(textPart) / 4
+			continue
+		}
+		total += estimatedTokensPerNonTextPart
+	}
+	return total
+}
+
+// selectModel applies the provider's ModelRouting policy to a single
+// request. Requests that are obviously short by a local estimate are routed
+// straight to FlashModel to keep them latency-sensitive; everything else is
+// measured precisely via CountTokens and routed to LargeContextModel once it
+// exceeds LargeContextThreshold. DefaultModel is the normal path for
+// anything that's neither small nor over the large-context threshold, and
+// is also the fallback if CountTokens itself fails.
+func (g *Gemini) selectModel(ctx context.Context, history []*genai.Content, lastParts []genai.Part) string {
+	routing := g.config.ModelRouting
+
+	parts := flattenContentParts(history)
+	parts = append(parts, lastParts...)
+
+	if routing.FlashModel != "" && estimateTokens(parts) <= smallRequestTokenThreshold {
+		return routing.FlashModel
+	}
+
+	counter := g.client.GenerativeModel(routing.DefaultModel)
+	count, err := counter.CountTokens(ctx, parts...)
+	if err != nil {
+		return routing.DefaultModel
+	}
+
+	if routing.LargeContextModel != "" && int32(count.TotalTokens) > routing.LargeContextThreshold {
+		return routing.LargeContextModel
+	}
+
+	return routing.DefaultModel
+}
+
+// flattenContentParts collects the parts of a sequence of Content values,
+// e.g. so they can all be passed to CountTokens at once.
+func flattenContentParts(contents []*genai.Content) []genai.Part {
+	var parts []genai.Part
+	for _, content := range contents {
+		parts = append(parts, content.Parts...)
+	}
+	return parts
+}
+
+// configureTools assigns any tools requested through llm.Option to the
+// model, along with a ToolConfig reflecting the caller's tool choice, so
+// Gemini can participate in the plugin's agentic tool-calling flows the
+// same way the OpenAI provider does.
+func (g *Gemini) configureTools(model *genai.GenerativeModel, opts llm.Options) {
+	if len(opts.Tools) == 0 {
+		return
+	}
+
+	model.Tools = toGeminiTools(opts.Tools)
+
+	mode := genai.FunctionCallingAuto
+	switch opts.ToolChoice {
+	case llm.ToolChoiceRequired:
+		mode = genai.FunctionCallingAny
+	case llm.ToolChoiceNone:
+		mode = genai.FunctionCallingNone
+	}
+
+	model.ToolConfig = &genai.ToolConfig{
+		FunctionCallingConfig: &genai.FunctionCallingConfig{Mode: mode},
+	}
+}
+
+// toGeminiTools converts the tools attached to an llm.Option into the
+// FunctionDeclaration values GenerativeModel.Tools expects.
+func toGeminiTools(tools []llm.Tool) []*genai.Tool {
+	declarations := make([]*genai.FunctionDeclaration, 0, len(tools))
+	for _, tool := range tools {
+		declarations = append(declarations, &genai.FunctionDeclaration{
+			Name:        tool.Name,
+			Description: tool.Description,
+			Parameters:  jsonSchemaToGenaiSchema(tool.Schema),
+		})
+	}
+
+	return []*genai.Tool{{FunctionDeclarations: declarations}}
+}
+
+// jsonSchema mirrors the subset of JSON Schema that llm.Tool.Schema is
+// expected to contain, so it can be translated into genai.Schema.
+type jsonSchema struct {
+	Type        string                `json:"type"`
+	Description string                `json:"description,omitempty"`
+	Enum        []string              `json:"enum,omitempty"`
+	Properties  map[string]jsonSchema `json:"properties,omitempty"`
+	Items       *jsonSchema           `json:"items,omitempty"`
+	Required    []string              `json:"required,omitempty"`
+}
+
+var jsonSchemaTypeToGenai = map[string]genai.Type{
+	"object":  genai.TypeObject,
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+}
+
+// jsonSchemaToGenaiSchema converts a tool's raw JSON schema parameters into a
+// genai.Schema. Unrecognized input is treated as a schema-less object so a
+// malformed tool definition doesn't prevent the other tools on the request
+// from being usable.
+func jsonSchemaToGenaiSchema(raw json.RawMessage) *genai.Schema {
+	if len(raw) == 0 {
+		return &genai.Schema{Type: genai.TypeObject}
+	}
+
+	var schema jsonSchema
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return &genai.Schema{Type: genai.TypeObject}
+	}
+
+	return schema.toGenai()
+}
+
+func (s jsonSchema) toGenai() *genai.Schema {
+	genaiSchema := &genai.Schema{
+		Type:        jsonSchemaTypeToGenai[s.Type],
+		Description: s.Description,
+		Enum:        s.Enum,
+		Required:    s.Required,
+	}
+
+	if len(s.Properties) > 0 {
+		genaiSchema.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, prop := range s.Properties {
+			genaiSchema.Properties[name] = prop.toGenai()
+		}
+	}
+
+	if s.Items != nil {
+		genaiSchema.Items = s.Items.toGenai()
+	}
+
+	return genaiSchema
+}
+
+// extractToolCalls pulls any genai.FunctionCall parts out of a candidate's
+// content and converts them into llm.ToolCall values for the caller.
+func extractToolCalls(parts []genai.Part) []llm.ToolCall {
+	var calls []llm.ToolCall
+	for _, part := range parts {
+		functionCall, ok := part.(genai.FunctionCall)
+		if !ok {
+			continue
+		}
+
+		arguments, err := json.Marshal(functionCall.Args)
+		if err != nil {
+			continue
+		}
+
+		calls = append(calls, llm.ToolCall{
+			Name:      functionCall.Name,
+			Arguments: arguments,
+		})
+	}
+	return calls
+}
+
+// GetEmbedding implements the llm.LanguageModel interface
+func (g *Gemini) GetEmbedding(ctx context.Context, input string) ([]float32, error) {
+	if g.client == nil {
+		if err := g.Initialize(); err != nil {
+			return nil, err
+		}
+	}
+
+	if g.metrics != nil {
+		g.metrics.ObserveRequest()
+		defer g.metrics.ObserveResponse()
+	}
+
+	em := g.client.EmbeddingModel(g.config.EmbeddingModelName)
+
+	resp, err := em.EmbedContent(ctx, genai.Text(input))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate embedding: %w", err)
+	}
+
+	if resp.Embedding == nil {
+		return nil, errors.New("no embedding generated")
+	}
+
+	return resp.Embedding.Values, nil
+}
+
+// GetEmbeddings embeds multiple inputs in a single BatchEmbedContents call,
+// which is significantly more efficient than calling GetEmbedding once per
+// chunk when the RAG/search subsystem needs to index many chunks at once.
+func (g *Gemini) GetEmbeddings(ctx context.Context, inputs []string) ([][]float32, error) {
 	if g.client == nil {
 		if err := g.Initialize(); err != nil {
 			return nil, err
 		}
 	}
-	
+
+	if g.metrics != nil {
+		g.metrics.ObserveRequest()
+		defer g.metrics.ObserveResponse()
+	}
+
+	em := g.client.EmbeddingModel(g.config.EmbeddingModelName)
+
+	batch := em.NewBatch()
+	for _, input := range inputs {
+		batch.AddContent(genai.Text(input))
+	}
+
+	resp, err := em.BatchEmbedContents(ctx, batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate batch embeddings: %w", err)
+	}
+
+	embeddings := make([][]float32, 0, len(resp.Embeddings))
+	for _, embedding := range resp.Embeddings {
+		embeddings = append(embeddings, embedding.Values)
+	}
+
+	return embeddings, nil
+}
+
+// oggMagic, flacMagic and webmMagic are the container magic bytes
+// http.DetectContentType either misidentifies or doesn't recognize at all:
+// it sniffs OGG as "application/ogg" (no audio/ prefix), has no signature
+// for FLAC, and reports WebM audio as "video/webm".
+var (
+	oggMagic  = []byte("OggS")
+	flacMagic = []byte("fLaC")
+	webmMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+)
+
+// detectAudioMimeType sniffs the MIME type of raw audio bytes, since the
+// llm.LanguageModel interface doesn't give GetTranscription the caller's
+// original content type and Mattermost attachments can be wav/ogg/m4a/etc,
+// not just mp3. It checks container magic bytes directly for formats
+// net/http's web-content-oriented sniffer gets wrong or misses entirely,
+// falling back to http.DetectContentType (which handles wav/mp3/aiff fine)
+// and finally to audio/mpeg when nothing matches.
+func detectAudioMimeType(audioData []byte) string {
+	switch {
+	case bytes.HasPrefix(audioData, oggMagic):
+		return "audio/ogg"
+	case bytes.HasPrefix(audioData, flacMagic):
+		return "audio/flac"
+	case bytes.HasPrefix(audioData, webmMagic):
+		return "audio/webm"
+	case len(audioData) >= 12 && bytes.Equal(audioData[4:8], []byte("ftyp")) && bytes.HasPrefix(audioData[8:12], []byte("M4A")):
+		return "audio/mp4"
+	}
+
+	if mimeType := http.DetectContentType(audioData); strings.HasPrefix(mimeType, "audio/") {
+		return mimeType
+	}
+
+	return "audio/mpeg"
+}
+
+// GetTranscription implements the llm.LanguageModel interface by uploading
+// the audio to Gemini's File API and asking the model to transcribe it,
+// since the Go SDK has no dedicated transcription endpoint.
+func (g *Gemini) GetTranscription(ctx context.Context, audioData []byte, prompt string) (string, error) {
+	if g.client == nil {
+		if err := g.Initialize(); err != nil {
+			return "", err
+		}
+	}
+
+	if g.metrics != nil {
+		g.metrics.ObserveRequest()
+		defer g.metrics.ObserveResponse()
+	}
+
+	if prompt == "" {
+		prompt = "Transcribe the audio verbatim."
+	}
+
+	file, err := g.client.UploadFile(ctx, "", bytes.NewReader(audioData), &genai.UploadFileOptions{MIMEType: detectAudioMimeType(audioData)})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload audio for transcription: %w", err)
+	}
+	defer g.cleanupUploadedFiles([]string{file.Name})
+
 	model := g.client.GenerativeModel(g.config.ModelName)
-	
-	// Configure the model
-	model.SetTemperature(float64(g.config.Temperature))
-	if g.config.MaxTokens > 0 {
-		model.SetMaxOutputTokens(int32(g.config.MaxTokens))
+	g.configureModel(model)
+
+	resp, err := model.GenerateContent(ctx, genai.FileData{MIMEType: file.MIMEType, URI: file.URI}, genai.Text(prompt))
+	if err != nil {
+		return "", fmt.Errorf("failed to transcribe audio: %w", err)
 	}
-	if g.config.TopP > 0 {
-		model.SetTopP(float64(g.config.TopP))
+
+	if err := g.checkBlocked(resp); err != nil {
+		return "", err
 	}
-	if g.config.TopK > 0 {
-		model.SetTopK(g.config.TopK)
+
+	if len(resp.Candidates) == 0 {
+		return "", errors.New("no transcription generated")
+	}
+
+	parts := candidateParts(resp.Candidates[0])
+	if len(parts) == 0 {
+		return "", errors.New("no transcription generated")
+	}
+
+	transcript := ""
+	for _, part := range parts {
+		if textPart, ok := part.(genai.Text); ok {
+			transcript += string(textPart)
+		}
+	}
+
+	return transcript, nil
+}
+
+// GetVision implements the llm.LanguageModel interface
+func (g *Gemini) GetVision(ctx context.Context, messages []llm.Message, options ...llm.Option) (*llm.Response, error) {
+	if g.client == nil {
+		if err := g.Initialize(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 1.5-series and newer models are natively multimodal, so which model
+	// handles a vision request is driven by the same ModelRouting policy as
+	// GetChatCompletion rather than a dedicated "-vision" model name.
+	systemInstruction, chatMessages := splitSystemInstruction(messages)
+
+	if len(chatMessages) == 0 {
+		return nil, errors.New("no messages to send")
+	}
+
+	lastMessage := chatMessages[len(chatMessages)-1]
+
+	var uploaded []string
+	defer func() { g.cleanupUploadedFiles(uploaded) }()
+
+	history, historyUploaded, err := g.toGeminiContents(ctx, chatMessages[:len(chatMessages)-1])
+	uploaded = append(uploaded, historyUploaded...)
+	if err != nil {
+		return nil, err
+	}
+
+	lastParts, lastUploaded, err := g.toGeminiParts(ctx, lastMessage)
+	uploaded = append(uploaded, lastUploaded...)
+	if err != nil {
+		return nil, err
 	}
-	
+
+	model := g.client.GenerativeModel(g.selectModel(ctx, history, lastParts))
+	g.configureModel(model)
+	model.SystemInstruction = systemInstruction
+
+	cs := model.StartChat()
+	cs.History = history
+
 	// Generate content
-	resp, err := model.GenerateContent(ctx, geminiContents...)
+	resp, err := cs.SendMessage(ctx, lastParts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate vision content: %w", err)
 	}
-	
-	if len(resp.Candidates) == 0 || len(resp.Candidates[0].Content.Parts) == 0 {
+
+	if err := g.checkBlocked(resp); err != nil {
+		return nil, err
+	}
+
+	if len(resp.Candidates) == 0 {
 		return nil, errors.New("no vision response generated")
 	}
-	
+
 	// Extract the response text
+	candidate := resp.Candidates[0]
+	parts := candidateParts(candidate)
+	if len(parts) == 0 {
+		return nil, errors.New("no vision response generated")
+	}
+
 	responseText := ""
-	for _, part := range resp.Candidates[0].Content.Parts {
+	for _, part := range parts {
 		if textPart, ok := part.(genai.Text); ok {
 			responseText += string(textPart)
 		}
 	}
-	
+
 	return &llm.Response{
 		Content: responseText,
+		Warning: maxTokensWarning(candidate),
 	}, nil
 }
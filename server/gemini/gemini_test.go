@@ -0,0 +1,294 @@
+// Copyright (c) 2023-present Mattermost, Inc. All Rights Reserved.
+// See LICENSE.txt for license information.
+
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/mattermost/mattermost-plugin-ai/server/llm"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []genai.Part
+		want  int
+	}{
+		{
+			name:  "empty",
+			parts: nil,
+			want:  0,
+		},
+		{
+			name:  "short text uses four chars per token",
+			parts: []genai.Part{genai.Text(strings.Repeat("a", 40))},
+			want:  10,
+		},
+		{
+			name:  "non-text part uses the flat per-part estimate",
+			parts: []genai.Part{genai.Blob{MIMEType: "image/png", Data: []byte("x")}},
+			want:  estimatedTokensPerNonTextPart,
+		},
+		{
+			name: "mixed parts sum their estimates",
+			parts: []genai.Part{
+				genai.Text(strings.Repeat("a", 40)),
+				genai.Blob{MIMEType: "image/png", Data: []byte("x")},
+			},
+			want: 10 + estimatedTokensPerNonTextPart,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.parts); got != tt.want {
+				t.Errorf("estimateTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTokensBelowSmallRequestThreshold(t *testing.T) {
+	// A request this short must stay under the threshold that routes
+	// selectModel straight to FlashModel without a CountTokens round-trip.
+	parts := []genai.Part{genai.Text(strings.Repeat("a", 100))}
+
+	if got := estimateTokens(parts); got > smallRequestTokenThreshold {
+		t.Errorf("estimateTokens() = %d, want <= %d", got, smallRequestTokenThreshold)
+	}
+}
+
+func TestJSONSchemaToGenaiSchema(t *testing.T) {
+	raw := json.RawMessage(`{
+		"type": "object",
+		"description": "search parameters",
+		"required": ["query"],
+		"properties": {
+			"query": {"type": "string", "description": "the search query"},
+			"limit": {"type": "integer"},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`)
+
+	schema := jsonSchemaToGenaiSchema(raw)
+
+	if schema.Type != genai.TypeObject {
+		t.Errorf("Type = %v, want %v", schema.Type, genai.TypeObject)
+	}
+	if schema.Description != "search parameters" {
+		t.Errorf("Description = %q, want %q", schema.Description, "search parameters")
+	}
+	if len(schema.Required) != 1 || schema.Required[0] != "query" {
+		t.Errorf("Required = %v, want [query]", schema.Required)
+	}
+
+	query, ok := schema.Properties["query"]
+	if !ok {
+		t.Fatal("Properties missing \"query\"")
+	}
+	if query.Type != genai.TypeString {
+		t.Errorf("query.Type = %v, want %v", query.Type, genai.TypeString)
+	}
+
+	tags, ok := schema.Properties["tags"]
+	if !ok {
+		t.Fatal("Properties missing \"tags\"")
+	}
+	if tags.Type != genai.TypeArray || tags.Items == nil || tags.Items.Type != genai.TypeString {
+		t.Errorf("tags schema = %+v, want array of strings", tags)
+	}
+}
+
+func TestJSONSchemaToGenaiSchemaFallsBackOnMalformedInput(t *testing.T) {
+	schema := jsonSchemaToGenaiSchema(json.RawMessage(`not json`))
+	if schema.Type != genai.TypeObject {
+		t.Errorf("Type = %v, want %v for malformed input", schema.Type, genai.TypeObject)
+	}
+
+	schema = jsonSchemaToGenaiSchema(nil)
+	if schema.Type != genai.TypeObject {
+		t.Errorf("Type = %v, want %v for empty input", schema.Type, genai.TypeObject)
+	}
+}
+
+func TestToGeminiSafetySettings(t *testing.T) {
+	settings := toGeminiSafetySettings([]SafetySetting{
+		{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_ONLY_HIGH"},
+		{Category: "not a real category", Threshold: "BLOCK_ONLY_HIGH"},
+		{Category: "HARM_CATEGORY_HATE_SPEECH", Threshold: "not a real threshold"},
+	})
+
+	if len(settings) != 1 {
+		t.Fatalf("len(settings) = %d, want 1 (unrecognized entries should be skipped)", len(settings))
+	}
+	if settings[0].Category != genai.HarmCategoryHarassment {
+		t.Errorf("Category = %v, want %v", settings[0].Category, genai.HarmCategoryHarassment)
+	}
+	if settings[0].Threshold != genai.HarmBlockOnlyHigh {
+		t.Errorf("Threshold = %v, want %v", settings[0].Threshold, genai.HarmBlockOnlyHigh)
+	}
+}
+
+func TestCheckBlocked(t *testing.T) {
+	g := &Gemini{
+		config: Config{
+			SafetySettings: []SafetySetting{
+				{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_LOW_AND_ABOVE"},
+			},
+		},
+	}
+
+	t.Run("prompt blocked", func(t *testing.T) {
+		resp := &genai.GenerateContentResponse{
+			PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockReasonSafety},
+		}
+
+		err := g.checkBlocked(resp)
+		var safetyErr *llm.SafetyBlockedError
+		if !errors.As(err, &safetyErr) {
+			t.Fatalf("checkBlocked() = %v, want a *llm.SafetyBlockedError", err)
+		}
+		if safetyErr.Reason != genai.BlockReasonSafety.String() {
+			t.Errorf("Reason = %q, want %q", safetyErr.Reason, genai.BlockReasonSafety.String())
+		}
+	})
+
+	t.Run("candidate blocked uses the admin-configured threshold, not the model's probability", func(t *testing.T) {
+		resp := &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{
+				{
+					FinishReason: genai.FinishReasonSafety,
+					SafetyRatings: []*genai.SafetyRating{
+						{
+							Category:    genai.HarmCategoryHarassment,
+							Probability: genai.HarmProbabilityMedium,
+							Blocked:     true,
+						},
+					},
+				},
+			},
+		}
+
+		err := g.checkBlocked(resp)
+		var safetyErr *llm.SafetyBlockedError
+		if !errors.As(err, &safetyErr) {
+			t.Fatalf("checkBlocked() = %v, want a *llm.SafetyBlockedError", err)
+		}
+		if safetyErr.Threshold != "BLOCK_LOW_AND_ABOVE" {
+			t.Errorf("Threshold = %q, want the configured threshold %q, not the model's probability", safetyErr.Threshold, "BLOCK_LOW_AND_ABOVE")
+		}
+	})
+
+	t.Run("no block", func(t *testing.T) {
+		resp := &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{{FinishReason: genai.FinishReasonStop}},
+		}
+		if err := g.checkBlocked(resp); err != nil {
+			t.Errorf("checkBlocked() = %v, want nil", err)
+		}
+	})
+}
+
+func TestToGeminiPartsCarriesToolCallsAsFunctionCalls(t *testing.T) {
+	g := &Gemini{}
+
+	msg := llm.Message{
+		Role: llm.RoleAssistant,
+		ToolCalls: []llm.ToolCall{
+			{Name: "get_weather", Arguments: json.RawMessage(`{"location":"SF"}`)},
+		},
+	}
+
+	parts, _, err := g.toGeminiParts(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("toGeminiParts() error = %v", err)
+	}
+
+	var calls []genai.FunctionCall
+	for _, part := range parts {
+		if call, ok := part.(genai.FunctionCall); ok {
+			calls = append(calls, call)
+		}
+	}
+
+	if len(calls) != 1 {
+		t.Fatalf("got %d genai.FunctionCall parts, want 1 (the FunctionResponse that answers it must have a preceding FunctionCall in history)", len(calls))
+	}
+	if calls[0].Name != "get_weather" {
+		t.Errorf("Name = %q, want %q", calls[0].Name, "get_weather")
+	}
+	if calls[0].Args["location"] != "SF" {
+		t.Errorf("Args[\"location\"] = %v, want %q", calls[0].Args["location"], "SF")
+	}
+}
+
+func TestToGeminiContentsSendsToolResultsAsUserRole(t *testing.T) {
+	g := &Gemini{}
+
+	contents, _, err := g.toGeminiContents(context.Background(), []llm.Message{
+		{Role: llm.RoleTool, ToolResults: []llm.ToolResult{{Name: "get_weather", Content: "72F"}}},
+	})
+	if err != nil {
+		t.Fatalf("toGeminiContents() error = %v", err)
+	}
+
+	// genai.ChatSession.SendMessage can only send the live turn as role
+	// "user", so history entries for tool results must match that instead
+	// of claiming a "function" role the live turn can never actually use.
+	if contents[0].Role != "user" {
+		t.Errorf("Role = %q, want %q", contents[0].Role, "user")
+	}
+}
+
+func TestDetectAudioMimeType(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			name: "wav",
+			data: append([]byte("RIFF\x00\x00\x00\x00WAVE"), make([]byte, 16)...),
+			want: "audio/wave",
+		},
+		{
+			name: "ogg",
+			data: append([]byte("OggS"), make([]byte, 16)...),
+			want: "audio/ogg",
+		},
+		{
+			name: "flac",
+			data: append([]byte("fLaC"), make([]byte, 16)...),
+			want: "audio/flac",
+		},
+		{
+			name: "webm",
+			data: append([]byte{0x1A, 0x45, 0xDF, 0xA3}, make([]byte, 16)...),
+			want: "audio/webm",
+		},
+		{
+			name: "m4a",
+			data: append([]byte{0, 0, 0, 0x18}, append([]byte("ftypM4A \x00\x00\x00\x00"), make([]byte, 8)...)...),
+			want: "audio/mp4",
+		},
+		{
+			name: "unrecognized falls back to mp3",
+			data: []byte("not a recognizable audio format"),
+			want: "audio/mpeg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectAudioMimeType(tt.data); got != tt.want {
+				t.Errorf("detectAudioMimeType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}